@@ -0,0 +1,342 @@
+package webmock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mode controls how a Recorder treats requests passing through it.
+type Mode int
+
+const (
+	// ModeRecord always forwards requests to the upstream RoundTripper and
+	// (re-)writes every response to the cassette file.
+	ModeRecord Mode = iota
+
+	// ModeReplay never contacts the upstream RoundTripper. It serves
+	// responses from the cassette file and fails the request if none were
+	// recorded for it.
+	ModeReplay
+
+	// ModeReplayOrRecord serves a request from the cassette file if a
+	// response for it was recorded, and otherwise forwards it upstream and
+	// appends the result to the cassette file. This is convenient for local
+	// development, where new endpoints get recorded on demand; CI should
+	// generally use ModeReplay against a cassette committed to the repo.
+	ModeReplayOrRecord
+)
+
+// A Recorder wraps an upstream http.RoundTripper, recording request/response
+// pairs to a cassette file and replaying them on later runs. This lets
+// integration tests that talk to real dependencies be converted to
+// hermetic, offline tests.
+type Recorder struct {
+	upstream http.RoundTripper
+	path     string
+	mode     Mode
+
+	mu       sync.Mutex
+	cassette cassette
+	played   map[string]int
+}
+
+// NewRecorder creates a Recorder that wraps upstream and reads/writes its
+// cassette at path. In ModeReplay and ModeReplayOrRecord the cassette is
+// loaded immediately; a missing file is only tolerated in ModeReplayOrRecord,
+// where it's treated as an empty cassette.
+func NewRecorder(upstream http.RoundTripper, path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{
+		upstream: upstream,
+		path:     path,
+		mode:     mode,
+		played:   map[string]int{},
+	}
+
+	if mode == ModeRecord {
+		return r, nil
+	}
+
+	c, err := loadCassette(path)
+	if err != nil {
+		if mode == ModeReplayOrRecord && os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	r.cassette = c
+
+	return r, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	key := cassetteKey(req.Method, req.URL.String(), body)
+
+	if r.mode != ModeRecord {
+		if resp, ok := r.replay(key, req); ok {
+			return resp, nil
+		}
+		if r.mode == ModeReplay {
+			return nil, fmt.Errorf("webmock: no recorded response for %s %s", req.Method, req.URL)
+		}
+	}
+
+	return r.record(req, key, body)
+}
+
+func (r *Recorder) replay(key string, req *http.Request) (*http.Response, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := r.cassette.entriesFor(key)
+	if len(entries) == 0 {
+		return nil, false
+	}
+
+	idx := r.played[key]
+	if idx >= len(entries) {
+		idx = len(entries) - 1
+	} else {
+		r.played[key] = idx + 1
+	}
+
+	return entryToResponse(entries[idx], req), true
+}
+
+func (r *Recorder) record(req *http.Request, key string, body []byte) (*http.Response, error) {
+	resp, err := r.upstream.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, resp, err := newCassetteEntry(key, req.Method, req.URL.String(), body, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.cassette.Entries = append(r.cassette.Entries, entry)
+	r.played[key]++
+	saveErr := r.save()
+	r.mu.Unlock()
+
+	if saveErr != nil {
+		return nil, saveErr
+	}
+
+	return resp, nil
+}
+
+func (r *Recorder) save() error {
+	b, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(r.path, b, 0644)
+}
+
+// NewServerFromCassette creates a Server whose stubs are loaded from the
+// cassette file at path, one stub per distinct recorded request (method,
+// URL, query string and body) in it. Two entries that share a method and
+// path but differ in query string or body — e.g. paginated requests or
+// distinct POST payloads to the same endpoint — get distinguished stubs, so
+// they don't shadow each other. When a cassette has multiple responses
+// recorded for the exact same request, they're chained with Response.Then so
+// they replay in the order they were recorded, with the last one sticking.
+// The returned Server intercepts requests the same way as one created with
+// NewTransport, so it can stub arbitrary absolute URLs.
+func NewServerFromCassette(t Test, path string) *Server {
+	s := NewTransport(t)
+
+	c, err := loadCassette(path)
+	if err != nil {
+		t.Fatal(fmt.Errorf("webmock: failed to load cassette %s: %s", path, err))
+		return s
+	}
+
+	stubs := map[string]*Stub{}
+	tails := map[string]*Response{}
+
+	for _, e := range c.Entries {
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			continue
+		}
+
+		resp := entryToStubResponse(e)
+
+		stub, ok := stubs[e.Key]
+		if !ok {
+			matchers := []Matcher{Host(u.Host), BodyEquals(decodeBody(e.ReqBody, e.ReqBodyBase64))}
+			if u.RawQuery != "" {
+				matchers = append(matchers, QueryEquals(u.Query()))
+			}
+
+			stub = s.Stub(e.Method, u.Path, matchers...).AtLeast(1)
+			stub.response = resp
+			stubs[e.Key] = stub
+			tails[e.Key] = resp
+			continue
+		}
+
+		tails[e.Key] = tails[e.Key].Then(resp)
+	}
+
+	return s
+}
+
+type cassette struct {
+	Entries []cassetteEntry `json:"entries"`
+}
+
+func (c *cassette) entriesFor(key string) []cassetteEntry {
+	var entries []cassetteEntry
+	for _, e := range c.Entries {
+		if e.Key == key {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// A cassetteEntry is one recorded request/response pair. Key identifies the
+// request it was recorded for (method, URL and a hash of the request body),
+// so that repeated requests for the same endpoint replay in the order they
+// were recorded. ReqBody is kept separately (rather than just its hash) so
+// NewServerFromCassette can build a matcher that tells divergent entries for
+// the same path apart.
+type cassetteEntry struct {
+	Key           string              `json:"key"`
+	Method        string              `json:"method"`
+	URL           string              `json:"url"`
+	ReqBody       string              `json:"req_body,omitempty"`
+	ReqBodyBase64 bool                `json:"req_body_base64,omitempty"`
+	Status        int                 `json:"status"`
+	Header        map[string][]string `json:"header"`
+	Body          string              `json:"body"`
+	BodyBase64    bool                `json:"body_base64,omitempty"`
+}
+
+func loadCassette(path string) (cassette, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cassette{}, err
+	}
+
+	var c cassette
+	if err := json.Unmarshal(b, &c); err != nil {
+		return cassette{}, err
+	}
+
+	return c, nil
+}
+
+func cassetteKey(method, url string, body []byte) string {
+	hash := sha256.Sum256(body)
+	return fmt.Sprintf("%s %s %x", method, url, hash)
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	return b, nil
+}
+
+func newCassetteEntry(key, method, url string, reqBody []byte, resp *http.Response) (cassetteEntry, *http.Response, error) {
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return cassetteEntry{}, nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	entry := cassetteEntry{
+		Key:    key,
+		Method: method,
+		URL:    url,
+		Status: resp.StatusCode,
+		Header: map[string][]string(resp.Header),
+	}
+	entry.ReqBody, entry.ReqBodyBase64 = encodeBody(reqBody)
+	entry.Body, entry.BodyBase64 = encodeBody(b)
+
+	return entry, resp, nil
+}
+
+// encodeBody returns b as a string suitable for storing in a cassette entry,
+// falling back to base64 when b isn't valid UTF-8.
+func encodeBody(b []byte) (string, bool) {
+	if utf8.Valid(b) {
+		return string(b), false
+	}
+	return base64.StdEncoding.EncodeToString(b), true
+}
+
+// decodeBody reverses encodeBody.
+func decodeBody(s string, isBase64 bool) []byte {
+	if !isBase64 {
+		return []byte(s)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func entryBody(e cassetteEntry) []byte {
+	return decodeBody(e.Body, e.BodyBase64)
+}
+
+func entryToResponse(e cassetteEntry, req *http.Request) *http.Response {
+	body := entryBody(e)
+
+	header := http.Header{}
+	for k, v := range e.Header {
+		header[k] = v
+	}
+
+	return &http.Response{
+		StatusCode: e.Status,
+		Status:     fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+}
+
+func entryToStubResponse(e cassetteEntry) *Response {
+	header := http.Header{}
+	for k, v := range e.Header {
+		header[k] = v
+	}
+
+	return &Response{
+		status: e.Status,
+		header: header,
+		body:   entryBody(e),
+	}
+}
@@ -0,0 +1,337 @@
+package webmock_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/yourkarma/webmock"
+)
+
+var errNoMoreResponses = errors.New("stubRoundTripper: no more responses")
+
+type stubRoundTripper struct {
+	responses []*http.Response
+	calls     int
+}
+
+func (rt *stubRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if rt.calls >= len(rt.responses) {
+		return nil, errNoMoreResponses
+	}
+	resp := rt.responses[rt.calls]
+	rt.calls++
+	return resp, nil
+}
+
+func newResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}
+}
+
+func TestRecorderRecordAndReplay(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	upstream := &stubRoundTripper{responses: []*http.Response{newResponse(200, "Bob")}}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: rec}
+	resp, err := client.Get("https://api.example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Bob" {
+		t.Fatalf("expected body %q, got %q", "Bob", body)
+	}
+	if upstream.calls != 1 {
+		t.Fatalf("expected upstream to be called once, got %d", upstream.calls)
+	}
+
+	replay, err := webmock.NewRecorder(upstream, cassette, webmock.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayClient := &http.Client{Transport: replay}
+	resp, err = replayClient.Get("https://api.example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Bob" {
+		t.Fatalf("expected replayed body %q, got %q", "Bob", body)
+	}
+	if upstream.calls != 1 {
+		t.Fatalf("expected upstream not to be called again during replay, got %d calls", upstream.calls)
+	}
+}
+
+func TestRecorderReplayFailsWithoutRecording(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	upstream := &stubRoundTripper{}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeReplayOrRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: rec}
+	if _, err := client.Get("https://api.example.com/users/1"); err == nil {
+		t.Fatal("expected an error since there's no cassette and no upstream response")
+	}
+}
+
+func TestNewServerFromCassetteDistinguishesQuery(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	upstream := &stubRoundTripper{responses: []*http.Response{
+		newResponse(200, "page1"),
+		newResponse(200, "page2"),
+	}}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: rec}
+	if _, err := client.Get("https://api.example.com/users?page=1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get("https://api.example.com/users?page=2"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := webmock.NewServerFromCassette(t, cassette)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"page=1", "page1"},
+		{"page=2", "page2"},
+	} {
+		resp, err := s.Client().Get("https://api.example.com/users?" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(body); got != tc.want {
+			t.Fatalf("query %q: expected body %q, got %q", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestNewServerFromCassetteDistinguishesBody(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	upstream := &stubRoundTripper{responses: []*http.Response{
+		newResponse(201, "created-bob"),
+		newResponse(201, "created-alice"),
+	}}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: rec}
+	if _, err := client.Post("https://api.example.com/users", "text/plain", bytes.NewReader([]byte("name=Bob"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Post("https://api.example.com/users", "text/plain", bytes.NewReader([]byte("name=Alice"))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := webmock.NewServerFromCassette(t, cassette)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{"name=Bob", "created-bob"},
+		{"name=Alice", "created-alice"},
+	} {
+		resp, err := s.Client().Post("https://api.example.com/users", "text/plain", bytes.NewReader([]byte(tc.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(body); got != tc.want {
+			t.Fatalf("request body %q: expected response %q, got %q", tc.body, tc.want, got)
+		}
+	}
+}
+
+func TestNewServerFromCassette(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	upstream := &stubRoundTripper{responses: []*http.Response{newResponse(200, "Bob")}}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordClient := &http.Client{Transport: rec}
+	if _, err := recordClient.Get("https://api.example.com/users/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := webmock.NewServerFromCassette(t, cassette)
+	defer s.Close()
+
+	resp, err := s.Client().Get("https://api.example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Bob" {
+		t.Fatalf("expected body %q, got %q", "Bob", body)
+	}
+}
+
+func TestRecorderReplayOrRecordPersists(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	upstream := &stubRoundTripper{responses: []*http.Response{newResponse(200, "Bob")}}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeReplayOrRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: rec}
+	resp, err := client.Get("https://api.example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Bob" {
+		t.Fatalf("expected body %q, got %q", "Bob", body)
+	}
+	if upstream.calls != 1 {
+		t.Fatalf("expected upstream to be called once, got %d", upstream.calls)
+	}
+
+	// A fresh Recorder in ModeReplay reads what was persisted to disk and
+	// doesn't need the upstream at all.
+	replay, err := webmock.NewRecorder(nil, cassette, webmock.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = (&http.Client{Transport: replay}).Get("https://api.example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Bob" {
+		t.Fatalf("expected persisted body %q, got %q", "Bob", body)
+	}
+}
+
+func TestRecorderChainedEntries(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	upstream := &stubRoundTripper{responses: []*http.Response{
+		newResponse(500, "error"),
+		newResponse(200, "ok"),
+	}}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: rec}
+	for range upstream.responses {
+		if _, err := client.Get("https://api.example.com/users/1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replay, err := webmock.NewRecorder(nil, cassette, webmock.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayClient := &http.Client{Transport: replay}
+
+	for i, expect := range []string{"error", "ok", "ok"} {
+		resp, err := replayClient.Get("https://api.example.com/users/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(body); got != expect {
+			t.Fatalf("call %d: expected body %q, got %q", i+1, expect, got)
+		}
+	}
+}
+
+func TestCassetteBase64Fallback(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	nonUTF8 := []byte{0xff, 0xfe, 0xfd}
+	upstream := &stubRoundTripper{responses: []*http.Response{{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(nonUTF8)),
+	}}}
+	rec, err := webmock.NewRecorder(upstream, cassette, webmock.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: rec}
+	if _, err := client.Get("https://api.example.com/binary"); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := webmock.NewRecorder(nil, cassette, webmock.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: replay}).Get("https://api.example.com/binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, nonUTF8) {
+		t.Fatalf("expected non-UTF8 body to round-trip, got %v", body)
+	}
+}
@@ -1,13 +1,20 @@
 package webmock
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +26,11 @@ type Test interface {
 	Fatal(...interface{})
 }
 
+// errConnReset is the error reported when a Response configured with
+// ConnReset or Error(nil) hijacks and closes a connection that isn't
+// otherwise associated with a custom error.
+var errConnReset = errors.New("webmock: connection reset by stub")
+
 // A Server is a wrapper around httptest.Server that allows creating
 // and verifying stubs that return predefined responses.
 type Server struct {
@@ -39,7 +51,7 @@ type Server struct {
 func NewServer(t Test, options ...func(*Server)) *Server {
 	s := &Server{
 		test:    t,
-		handler: &handler{verified: true, mu: &sync.Mutex{}, fail: t.Error},
+		handler: &handler{mu: &sync.Mutex{}, fail: t.Error},
 	}
 
 	for _, opt := range options {
@@ -55,11 +67,50 @@ func NewServer(t Test, options ...func(*Server)) *Server {
 	return s
 }
 
+// NewTransport creates a Server that intercepts requests through an
+// http.RoundTripper instead of listening on a local address. Use Transport or
+// Client to route requests made by code under test, including requests to
+// arbitrary absolute URLs, through its stubs. Callers should call Close or
+// Verify to finish up, same as with NewServer.
+func NewTransport(t Test, options ...func(*Server)) *Server {
+	s := &Server{
+		test:    t,
+		handler: &handler{mu: &sync.Mutex{}, fail: t.Error},
+	}
+
+	for _, opt := range options {
+		opt(s)
+	}
+
+	return s
+}
+
+// Transport returns an http.RoundTripper that serves requests from this
+// Server's stubs directly, without a network listener.
+func (s *Server) Transport() http.RoundTripper {
+	return roundTripper{handler: s.handler}
+}
+
+// Client returns an *http.Client whose Transport routes every request
+// through this Server's stubs.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: s.Transport()}
+}
+
+// Close shuts down the underlying httptest.Server, if one was started by
+// NewServer. It is a no-op for a Server created with NewTransport.
+func (s *Server) Close() {
+	if s.Server != nil {
+		s.Server.Close()
+	}
+}
+
 // Stub registers a stub that is matched by HTTP method, path and other optional
 // matchers against each incoming request to the server. Stubs are matched in
 // the order they were registered. The stub with the most matches will be
 // selected and its configured Response will be called to generate an HTTP
-// response. After a stub is matched, it won't match again.
+// response. By default a stub matches exactly once; use Times, AtLeast,
+// AtMost or Never to configure how many times it's allowed to match.
 func (s *Server) Stub(method, path string, matchers ...Matcher) *Stub {
 	return s.stub(&Stub{
 		method:   method,
@@ -84,11 +135,33 @@ func (s *Server) StubMatch(method, pathRegexp string, matchers ...Matcher) *Stub
 func (s *Server) stub(stub *Stub) *Stub {
 	s.handler.mu.Lock()
 	defer s.handler.mu.Unlock()
-	s.handler.verified = false
 	s.handler.stubs = append(s.handler.stubs, stub)
 	return stub
 }
 
+// InOrder asserts that each of the given stubs was matched before the next
+// one in the list, based on the order in which matching requests arrived. It
+// fails the test immediately if a stub in the list hasn't been matched yet or
+// if the stubs were matched out of order. Stubs not included in the call are
+// ignored, so InOrder can assert ordering for a subset of the registered
+// stubs.
+func (s *Server) InOrder(stubs ...*Stub) {
+	s.handler.mu.Lock()
+	defer s.handler.mu.Unlock()
+
+	for i, stub := range stubs {
+		if stub.firstMatch == 0 {
+			s.test.Error(fmt.Errorf("\n\nInOrder: stub has not been matched: %s", stub))
+			return
+		}
+
+		if i > 0 && stubs[i-1].firstMatch > stub.firstMatch {
+			s.test.Error(orderErr(stubs[i-1], stub))
+			return
+		}
+	}
+}
+
 // Verify checks if all stubs have matching requests and markes the test as
 // failed if there are unmatched stubs. It optionally waits for the Timeout
 // duration to elapse, to allow for late requests. Call Close if matching stubs
@@ -135,16 +208,28 @@ func DefaultStatus(status int) func(*Server) {
 type handler struct {
 	fail          func(...interface{})
 	defaultStatus int
-	verified      bool
 	stubs         []*Stub
+	seq           int
 	mu            *sync.Mutex
 }
 
+// connDropper lets a ResponseWriter that has no real network connection to
+// sever (e.g. the one roundTripper hands ServeHTTP) observe the error a
+// dropped-connection stub would otherwise only report through http.Hijacker.
+type connDropper interface {
+	dropConn(err error)
+}
+
 func (h *handler) allVerified() bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	return h.verified
+	for _, stub := range h.stubs {
+		if !stub.satisfied() {
+			return false
+		}
+	}
+	return true
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -153,39 +238,61 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	req := Request{Request: r}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		h.fail(err)
-		return
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			h.fail(err)
+			return
+		}
+		req.body = body
 	}
-	req.body = body
 
 	stub := findMatch(&req, h.stubs)
 	if stub == nil {
 		h.fail(requestErr(req, h.stubs))
 		return
 	}
-	stub.matched = true
+	stub.calls++
+	if stub.firstMatch == 0 {
+		h.seq++
+		stub.firstMatch = h.seq
+	}
 
-	h.verified = true
-	for _, stub := range h.stubs {
-		if !stub.matched {
-			h.verified = false
-			break
+	resp := stub.activeResponse()
+
+	if resp.delay > 0 {
+		time.Sleep(resp.delay)
+	}
+
+	if resp.dropConn {
+		if cd, ok := w.(connDropper); ok {
+			cd.dropConn(resp.connErr())
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			h.fail(resp.connErr())
+			return
 		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			h.fail(err)
+			return
+		}
+		conn.Close()
+		return
 	}
 
-	if fn := stub.response.handler; fn != nil {
+	if fn := resp.handler; fn != nil {
 		fn(w, r)
 		return
 	}
 
-	for k, v := range stub.response.header {
+	for k, v := range resp.header {
 		for _, vv := range v {
 			w.Header().Add(k, vv)
 		}
 	}
-	status := stub.response.status
+	status := resp.status
 	if status == 0 {
 		if h.defaultStatus != 0 {
 			status = h.defaultStatus
@@ -194,7 +301,7 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	w.WriteHeader(status)
-	if _, err := w.Write(stub.response.body); err != nil {
+	if _, err := w.Write(resp.body); err != nil {
 		h.fail(err)
 	}
 }
@@ -205,17 +312,95 @@ type Stub struct {
 	path       string
 	pathRegexp *regexp.Regexp
 	matchers   []Matcher
-	matched    bool
+
+	calls      int
+	firstMatch int
+	times      *int
+	atLeast    *int
+	atMost     *int
 
 	response *Response
 }
 
+// Times sets an exact expectation for the number of times the stub must be
+// matched. Verify fails if the stub is matched fewer times; once it has been
+// matched n times it no longer matches, so further requests that only it
+// would match are reported as unregistered.
+func (s *Stub) Times(n int) *Stub {
+	s.times = &n
+	return s
+}
+
+// AtLeast sets a minimum number of times the stub must be matched. Verify
+// fails if the stub is matched fewer times.
+func (s *Stub) AtLeast(n int) *Stub {
+	s.atLeast = &n
+	return s
+}
+
+// AtMost sets a maximum number of times the stub may be matched. Once it has
+// been matched n times it no longer matches, so further requests that only it
+// would match are reported as unregistered.
+func (s *Stub) AtMost(n int) *Stub {
+	s.atMost = &n
+	return s
+}
+
+// Never is a shorthand for AtMost(0), asserting that the stub is never
+// matched.
+func (s *Stub) Never() *Stub {
+	return s.AtMost(0)
+}
+
+// available reports whether the stub can still be matched against another
+// request, based on the configured count expectations.
+func (s *Stub) available() bool {
+	switch {
+	case s.times != nil:
+		return s.calls < *s.times
+	case s.atMost != nil:
+		return s.calls < *s.atMost
+	case s.atLeast != nil:
+		return true
+	default:
+		return s.calls < 1
+	}
+}
+
+// satisfied reports whether the stub's count expectations have been met.
+func (s *Stub) satisfied() bool {
+	switch {
+	case s.times != nil:
+		return s.calls == *s.times
+	case s.atLeast != nil && s.atMost != nil:
+		return s.calls >= *s.atLeast && s.calls <= *s.atMost
+	case s.atLeast != nil:
+		return s.calls >= *s.atLeast
+	case s.atMost != nil:
+		return s.calls <= *s.atMost
+	default:
+		return s.calls == 1
+	}
+}
+
 // A Response represents the HTTP response for a stubbed request.
 type Response struct {
 	status  int
 	body    []byte
 	header  http.Header
 	handler func(http.ResponseWriter, *http.Request)
+
+	delay    time.Duration
+	after    *int
+	next     *Response
+	dropConn bool
+	err      error
+}
+
+// NewResponse creates a standalone Response with the given status. It is
+// used with Response.Then to build a sequence of responses for a stub.
+func NewResponse(status int) *Response {
+	return &Response{status: status}
 }
 
 // Body sets the body on a Response.
@@ -230,6 +415,88 @@ func (r *Response) Header(h http.Header) *Response {
 	return r
 }
 
+// JSON marshals v and sets it as the Response body, setting the
+// Content-Type header to application/json. It panics if v cannot be
+// marshaled.
+func (r *Response) JSON(v interface{}) *Response {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	r.body = b
+	r.setContentType("application/json")
+	return r
+}
+
+// XML marshals v and sets it as the Response body, setting the
+// Content-Type header to application/xml. It panics if v cannot be
+// marshaled.
+func (r *Response) XML(v interface{}) *Response {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	r.body = b
+	r.setContentType("application/xml")
+	return r
+}
+
+func (r *Response) setContentType(contentType string) {
+	if r.header == nil {
+		r.header = http.Header{}
+	}
+	r.header.Set("Content-Type", contentType)
+}
+
+// Delay sets a duration the Response waits before writing, to simulate slow
+// endpoints.
+func (r *Response) Delay(d time.Duration) *Response {
+	r.delay = d
+	return r
+}
+
+// After restricts the Response to only activate starting on the stub's nth
+// match. Earlier matches fall back to the Server's default status with an
+// empty body.
+func (r *Response) After(n int) *Response {
+	r.after = &n
+	return r
+}
+
+// Then chains next to be returned starting on the stub's following match,
+// and returns next so further calls can continue the chain. Once the chain
+// is exhausted, the last Response added keeps being returned.
+func (r *Response) Then(next *Response) *Response {
+	r.next = next
+	return next
+}
+
+// Error marks the Response to hijack and close the underlying connection
+// without writing a response, so the client observes a transport error
+// (err, or a generic connection-reset error if err is nil) instead of a
+// response. This works with both NewServer and NewTransport/Server.Client;
+// it's reported as a test failure only if the ResponseWriter behind the
+// request supports neither a real connection to hijack nor simulating one.
+func (r *Response) Error(err error) *Response {
+	r.dropConn = true
+	r.err = err
+	return r
+}
+
+// ConnReset is a shorthand for Error with a generic connection-reset error.
+func (r *Response) ConnReset() *Response {
+	return r.Error(nil)
+}
+
+func (r *Response) connErr() error {
+	if r.err != nil {
+		return r.err
+	}
+	return errConnReset
+}
+
 func (s Stub) String() string {
 	var path string
 	if s.pathRegexp != nil {
@@ -276,6 +543,27 @@ func (s *Stub) matches(r Request) int {
 	return score
 }
 
+// activeResponse returns the Response to use for the stub's current call,
+// walking any chain built with Response.Then and honoring Response.After.
+// It never returns nil: a Response gated by After that hasn't activated yet
+// falls back to a zero-value Response, so the caller uses the Server's
+// default status with an empty body.
+func (s *Stub) activeResponse() *Response {
+	resp := s.response
+	for i := 1; i < s.calls; i++ {
+		if resp.next == nil {
+			break
+		}
+		resp = resp.next
+	}
+
+	if resp.after != nil && s.calls < *resp.after {
+		return &Response{}
+	}
+
+	return resp
+}
+
 func (s *Stub) methodAndPathMatch(r Request) bool {
 	if s.method != r.Method {
 		return false
@@ -331,6 +619,138 @@ func (b bodyMatcher) String() string {
 	return fmt.Sprintf("body: %q", value)
 }
 
+type jsonMatcher struct {
+	v interface{}
+}
+
+// JSONEquals creates a Matcher that decodes the body of a request as JSON
+// and compares it structurally to v, ignoring key order and whitespace.
+func JSONEquals(v interface{}) Matcher {
+	return jsonMatcher{v: v}
+}
+
+func (j jsonMatcher) Match(r Request) bool {
+	var actual interface{}
+	if err := json.Unmarshal(r.body, &actual); err != nil {
+		return false
+	}
+
+	expected, ok := normalizeJSON(j.v)
+	if !ok {
+		return false
+	}
+
+	return reflect.DeepEqual(actual, expected)
+}
+
+func (j jsonMatcher) String() string {
+	b, _ := json.Marshal(j.v)
+	return fmt.Sprintf("json: %s", b)
+}
+
+type jsonPathMatcher struct {
+	path     string
+	expected interface{}
+}
+
+// JSONPath creates a Matcher that decodes the body of a request as JSON and
+// compares the value found at expr to expected. expr is a dotted path, e.g.
+// "user.items.0.name", where numeric segments index into arrays. JSONPath
+// returns false when the path doesn't exist in the request body.
+func JSONPath(expr string, expected interface{}) Matcher {
+	return jsonPathMatcher{path: expr, expected: expected}
+}
+
+func (j jsonPathMatcher) Match(r Request) bool {
+	var doc interface{}
+	if err := json.Unmarshal(r.body, &doc); err != nil {
+		return false
+	}
+
+	actual, ok := walkJSONPath(doc, strings.Split(j.path, "."))
+	if !ok {
+		return false
+	}
+
+	expected, ok := normalizeJSON(j.expected)
+	if !ok {
+		return false
+	}
+
+	return reflect.DeepEqual(actual, expected)
+}
+
+func (j jsonPathMatcher) String() string {
+	b, _ := json.Marshal(j.expected)
+	return fmt.Sprintf("json path %q: %s", j.path, b)
+}
+
+// normalizeJSON round-trips v through JSON encoding so it can be compared
+// with reflect.DeepEqual against a value decoded from a request body.
+func normalizeJSON(v interface{}) (interface{}, bool) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(b, &normalized); err != nil {
+		return nil, false
+	}
+
+	return normalized, true
+}
+
+func walkJSONPath(doc interface{}, segments []string) (interface{}, bool) {
+	current := doc
+	for _, segment := range segments {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			v, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = v
+
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+type xmlMatcher struct {
+	v interface{}
+}
+
+// XMLEquals creates a Matcher that decodes the body of a request as XML into
+// a new value of the same type as v and compares it to v structurally.
+func XMLEquals(v interface{}) Matcher {
+	return xmlMatcher{v: v}
+}
+
+func (x xmlMatcher) Match(r Request) bool {
+	actual := reflect.New(reflect.TypeOf(x.v))
+	if err := xml.Unmarshal(r.body, actual.Interface()); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(actual.Elem().Interface(), x.v)
+}
+
+func (x xmlMatcher) String() string {
+	b, _ := xml.Marshal(x.v)
+	return fmt.Sprintf("xml: %s", b)
+}
+
 // HeaderEquals creates a Matcher that checks if the given header key
 // is present in the request header with the same value.
 func HeaderEquals(key string, value []string) Matcher {
@@ -351,6 +771,152 @@ func (h headerMatcher) String() string {
 	return fmt.Sprintf("%s: %s", h.key, strings.Join(h.value, ","))
 }
 
+// QueryEquals creates a Matcher that checks if the request's query string is
+// equal to values, independent of key order. Repeated keys are compared in
+// the order their values were given.
+func QueryEquals(values url.Values) Matcher {
+	return queryMatcher{values: values}
+}
+
+type queryMatcher struct {
+	values url.Values
+}
+
+func (q queryMatcher) Match(r Request) bool {
+	return reflect.DeepEqual(r.URL.Query(), q.values)
+}
+
+func (q queryMatcher) String() string {
+	return fmt.Sprintf("query: %s", q.values.Encode())
+}
+
+// QueryContains creates a Matcher that checks if the request's query string
+// has key set to value, among possibly other keys or repeated values.
+func QueryContains(key, value string) Matcher {
+	return queryContainsMatcher{key: key, value: value}
+}
+
+type queryContainsMatcher struct {
+	key   string
+	value string
+}
+
+func (q queryContainsMatcher) Match(r Request) bool {
+	for _, v := range r.URL.Query()[q.key] {
+		if v == q.value {
+			return true
+		}
+	}
+	return false
+}
+
+func (q queryContainsMatcher) String() string {
+	return fmt.Sprintf("query %s=%s", q.key, q.value)
+}
+
+// FormEquals creates a Matcher that parses the body of a request as
+// application/x-www-form-urlencoded and compares it to values, independent
+// of key order. Repeated keys are compared in the order their values were
+// given.
+func FormEquals(values url.Values) Matcher {
+	return formMatcher{values: values}
+}
+
+type formMatcher struct {
+	values url.Values
+}
+
+func (f formMatcher) Match(r Request) bool {
+	parsed, err := url.ParseQuery(string(r.body))
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(parsed, f.values)
+}
+
+func (f formMatcher) String() string {
+	return fmt.Sprintf("form: %s", f.values.Encode())
+}
+
+// MatchFunc creates a Matcher from fn, so ad-hoc matchers can be written
+// without declaring a named type. name is used when a stub's matchers are
+// printed in a failure message.
+func MatchFunc(name string, fn func(Request) bool) Matcher {
+	return funcMatcher{name: name, fn: fn}
+}
+
+type funcMatcher struct {
+	name string
+	fn   func(Request) bool
+}
+
+func (f funcMatcher) Match(r Request) bool {
+	return f.fn(r)
+}
+
+func (f funcMatcher) String() string {
+	return f.name
+}
+
+// roundTripper adapts a handler to the http.RoundTripper interface, so
+// stubs can intercept requests made through an http.Client instead of
+// requiring a listening Server.
+type roundTripper struct {
+	handler *handler
+}
+
+func (rt roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rt.handler.ServeHTTP(rec, r)
+
+	if rec.err != nil {
+		return nil, rec.err
+	}
+
+	resp := rec.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+// hijackRecorder wraps httptest.ResponseRecorder with a no-op http.Hijacker
+// and a connDropper, so a Response.Error/ConnReset stub can simulate a
+// dropped connection through Server.Transport/Client, which have no real
+// network connection for the handler to sever.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (rec *hijackRecorder) dropConn(err error) {
+	rec.err = err
+}
+
+func (rec *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	server, client := net.Pipe()
+	client.Close()
+	return server, nil, nil
+}
+
+// Host creates a Matcher that checks if the request's URL host matches
+// host. This is useful with Server.Transport or Server.Client to stub
+// requests by hostname, since Stub and StubMatch only match on path.
+func Host(host string) Matcher {
+	return hostMatcher{host: host}
+}
+
+type hostMatcher struct {
+	host string
+}
+
+func (h hostMatcher) Match(r Request) bool {
+	return r.URL.Host == h.host
+}
+
+func (h hostMatcher) String() string {
+	return fmt.Sprintf("host: %s", h.host)
+}
+
 // Request is a wrapper around http.Request.
 type Request struct {
 	body []byte
@@ -367,7 +933,7 @@ func findMatch(r *Request, stubs []*Stub) *Stub {
 	var match *Stub
 
 	for _, stub := range stubs {
-		if stub.matched {
+		if !stub.available() {
 			continue
 		}
 
@@ -388,11 +954,15 @@ func unmatchedStubsErr(stubs []*Stub) error {
 	return fmt.Errorf("\n\nNot all stubs have been matched: \n\n%s", stubList(stubs))
 }
 
+func orderErr(before, after *Stub) error {
+	return fmt.Errorf("\n\nStubs matched out of order: expected %s to be matched before %s", before, after)
+}
+
 func stubList(stubs []*Stub) string {
 	var list string
 	for i, stub := range stubs {
 		s := fmt.Sprintf("%d. %s", i+1, stub)
-		if stub.matched {
+		if stub.calls > 0 {
 			s += " (matched)"
 		}
 		s += "\n"
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/yourkarma/webmock"
 )
@@ -221,6 +222,380 @@ func TestHeaderEquals(t *testing.T) {
 	}
 }
 
+func TestQueryEquals(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	s.Stub("GET", "/users", webmock.QueryEquals(url.Values{"page": {"2"}, "sort": {"name"}}))
+	if _, err := http.Get(s.URL + "/users?sort=name&page=2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryContains(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	s.Stub("GET", "/users", webmock.QueryContains("page", "2"))
+	if _, err := http.Get(s.URL + "/users?page=2&sort=name"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormEquals(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	s.Stub("POST", "/", webmock.FormEquals(url.Values{"name": {"Bob"}}))
+	if _, err := http.PostForm(s.URL, url.Values{"name": {"Bob"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchFunc(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	hasUserAgent := webmock.MatchFunc("has user agent", func(r webmock.Request) bool {
+		return r.Header.Get("User-Agent") != ""
+	})
+	s.Stub("GET", "/users/1", hasUserAgent)
+
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Close()
+
+	s.Stub("GET", "/users/1").Respond(200).Delay(20 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected request to take at least 20ms, took %s", elapsed)
+	}
+}
+
+func TestResponseAfter(t *testing.T) {
+	s := webmock.NewServer(t, webmock.DefaultStatus(404))
+	defer s.Close()
+
+	s.Stub("GET", "/users/1").Times(3).Respond(200).After(3)
+
+	for i, expect := range []int{404, 404, 200} {
+		resp, err := http.Get(s.URL + "/users/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != expect {
+			t.Fatalf("call %d: expected status %d, got %d", i+1, expect, resp.StatusCode)
+		}
+	}
+}
+
+func TestResponseThen(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Close()
+
+	s.Stub("GET", "/users/1").AtLeast(3).Respond(500).
+		Then(webmock.NewResponse(503)).
+		Then(webmock.NewResponse(200))
+
+	for i, expect := range []int{500, 503, 200} {
+		resp, err := http.Get(s.URL + "/users/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != expect {
+			t.Fatalf("call %d: expected status %d, got %d", i+1, expect, resp.StatusCode)
+		}
+	}
+
+	// The last Response in the chain sticks once the chain is exhausted.
+	resp, err := http.Get(s.URL + "/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected status 200 to stick, got %d", resp.StatusCode)
+	}
+}
+
+func TestResponseConnReset(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Close()
+
+	s.Stub("GET", "/users/1").Respond(200).ConnReset()
+
+	if _, err := http.Get(s.URL + "/users/1"); err == nil {
+		t.Fatal("expected a transport error")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	s := webmock.NewTransport(t)
+	defer s.Verify()
+
+	s.Stub("GET", "/users/1", webmock.Host("api.example.com")).Respond(200).Body([]byte("Bob"))
+
+	client := s.Client()
+	resp, err := client.Get("https://api.example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(body); got != "Bob" {
+		t.Fatalf("expected body %q, got %q", "Bob", got)
+	}
+}
+
+func TestTransportRoundTripper(t *testing.T) {
+	s := webmock.NewTransport(t)
+	defer s.Verify()
+
+	s.Stub("GET", "/users/1", webmock.Host("api.example.com")).Respond(204)
+
+	client := &http.Client{Transport: s.Transport()}
+	resp, err := client.Get("https://api.example.com/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 204 {
+		t.Fatalf("expected status 204, got %d", resp.StatusCode)
+	}
+}
+
+func TestTransportConnReset(t *testing.T) {
+	s := webmock.NewTransport(t)
+	defer s.Verify()
+
+	s.Stub("GET", "/users/1", webmock.Host("api.example.com")).Respond(200).ConnReset()
+
+	client := s.Client()
+	if _, err := client.Get("https://api.example.com/users/1"); err == nil {
+		t.Fatal("expected a transport error")
+	}
+}
+
+func TestJSONEquals(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	s.Stub("POST", "/", webmock.JSONEquals(map[string]interface{}{"name": "Bob", "age": 30}))
+	body := strings.NewReader(`{"age": 30, "name": "Bob"}`)
+	if _, err := http.Post(s.URL, "application/json", body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	s.Stub("POST", "/", webmock.JSONPath("user.items.0.name", "widget"))
+	body := strings.NewReader(`{"user": {"items": [{"name": "widget"}]}}`)
+	if _, err := http.Post(s.URL, "application/json", body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONPathMissing(t *testing.T) {
+	test := &fakeTest{}
+	s := webmock.NewServer(test)
+	defer s.Close()
+
+	s.Stub("POST", "/", webmock.JSONPath("user.name", "Bob")).Respond(200)
+	body := strings.NewReader(`{"user": {}}`)
+	if _, err := http.Post(s.URL, "application/json", body); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.err == nil {
+		t.Fatal("expected the request to be reported as unregistered")
+	}
+}
+
+func TestResponseJSON(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Close()
+
+	s.Stub("GET", "/users/1").Respond(200).JSON(map[string]string{"name": "Bob"})
+
+	resp, err := http.Get(s.URL + "/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected Content-Type application/json, got %q", ct)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `{"name":"Bob"}`
+	if got := strings.TrimSpace(string(body)); got != expect {
+		t.Fatalf("expected body %q, got %q", expect, got)
+	}
+}
+
+func TestXMLEquals(t *testing.T) {
+	type person struct {
+		Name string `xml:"name"`
+	}
+
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	s.Stub("POST", "/", webmock.XMLEquals(person{Name: "Bob"}))
+	body := strings.NewReader(`<person><name>Bob</name></person>`)
+	if _, err := http.Post(s.URL, "application/xml", body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResponseXML(t *testing.T) {
+	type person struct {
+		Name string `xml:"name"`
+	}
+
+	s := webmock.NewServer(t)
+	defer s.Close()
+
+	s.Stub("GET", "/users/1").Respond(200).XML(person{Name: "Bob"})
+
+	resp, err := http.Get(s.URL + "/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/xml" {
+		t.Fatalf("expected Content-Type application/xml, got %q", ct)
+	}
+}
+
+func TestStubTimes(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+	s.Stub("GET", "/users/1").Times(2)
+
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStubTimesNotMet(t *testing.T) {
+	test := &fakeTest{}
+	s := webmock.NewServer(test)
+	s.Stub("GET", "/users/1").Times(2)
+
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+	s.Verify()
+
+	if test.err == nil {
+		t.Fatal("expected Verify to fail")
+	}
+}
+
+func TestStubAtLeast(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+	s.Stub("GET", "/users/1").AtLeast(2)
+
+	for i := 0; i < 3; i++ {
+		if _, err := http.Get(s.URL + "/users/1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStubAtMost(t *testing.T) {
+	test := &fakeTest{}
+	s := webmock.NewServer(test)
+	defer s.Close()
+	s.Stub("GET", "/users/1").AtMost(1)
+
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.err == nil {
+		t.Fatal("expected the second request to be reported as unregistered")
+	}
+}
+
+func TestStubNever(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+	s.Stub("GET", "/users/1").Never()
+}
+
+func TestInOrder(t *testing.T) {
+	s := webmock.NewServer(t)
+	defer s.Verify()
+
+	first := s.Stub("GET", "/users/1")
+	first.Respond(200)
+	second := s.Stub("GET", "/users/2")
+	second.Respond(200)
+
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(s.URL + "/users/2"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.InOrder(first, second)
+}
+
+func TestInOrderViolation(t *testing.T) {
+	test := &fakeTest{}
+	s := webmock.NewServer(test)
+	defer s.Close()
+
+	first := s.Stub("GET", "/users/1")
+	first.Respond(200)
+	second := s.Stub("GET", "/users/2")
+	second.Respond(200)
+
+	if _, err := http.Get(s.URL + "/users/2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(s.URL + "/users/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.InOrder(first, second)
+	if test.err == nil {
+		t.Fatal("expected InOrder to fail")
+	}
+}
+
 type fakeTest struct {
 	err error
 }